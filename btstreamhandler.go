@@ -0,0 +1,30 @@
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"github.com/doingodswork/deflix-stremio/pkg/btstream"
+)
+
+// createBTStreamHandler returns a handler that serves a torrent's largest
+// file directly over HTTP, seekably, by joining its swarm. It's used as the
+// stream URL for the "P2P (direct)" entries createStreamHandler adds when a
+// debrid provider doesn't have a hash cached.
+func createBTStreamHandler(btClient *btstream.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		infohash := mux.Vars(r)["infohash"]
+		if infohash == "" {
+			http.Error(w, "missing infohash", http.StatusBadRequest)
+			return
+		}
+
+		if err := btClient.ServeContent(w, r, infohash); err != nil {
+			log.Println("Couldn't serve P2P stream for", infohash, "-", err)
+			http.Error(w, "couldn't join swarm for this torrent", http.StatusBadGateway)
+			return
+		}
+	}
+}
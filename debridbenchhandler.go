@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/doingodswork/deflix-stremio/pkg/realdebrid"
+)
+
+// benchHash is a small, well-known torrent that's reliably cached on
+// RealDebrid, used to measure unrestrict + download performance without
+// depending on the user's own library.
+const benchHash = "08ada5a7a6183aae1e09d831df6748d566095a10"
+
+// benchRangeBytes is how much of the test file to download per stream.
+const benchRangeBytes = 8 * 1024 * 1024
+
+// latencyPercentiles holds p50/p95/p99 in milliseconds,
+// madmin.TimeDurations-style, computed over a sorted slice of durations.
+type latencyPercentiles struct {
+	P50 float64 `json:"p50Ms"`
+	P95 float64 `json:"p95Ms"`
+	P99 float64 `json:"p99Ms"`
+}
+
+func percentilesOf(durs []time.Duration) latencyPercentiles {
+	if len(durs) == 0 {
+		return latencyPercentiles{}
+	}
+	sorted := make([]time.Duration, len(durs))
+	copy(sorted, durs)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	at := func(q float64) float64 {
+		idx := int(q * float64(len(sorted)-1))
+		return float64(sorted[idx]) / float64(time.Millisecond)
+	}
+	return latencyPercentiles{
+		P50: at(0.50),
+		P95: at(0.95),
+		P99: at(0.99),
+	}
+}
+
+// debridBenchReport is the JSON response of /debridbench/{apitoken}.
+type debridBenchReport struct {
+	Provider            string             `json:"provider"`
+	AvailabilityChecks  int                `json:"availabilityChecks"`
+	AvailabilityLatency latencyPercentiles `json:"availabilityLatency"`
+	Streams             int                `json:"streams"`
+	TTFB                latencyPercentiles `json:"ttfb"`
+	ThroughputMBps      float64            `json:"throughputMBps"`
+}
+
+// createDebridBenchHandler probes RealDebrid's availability endpoint and
+// download throughput, so operators can tell whether slow Stremio playback
+// is caused by the debrid provider or by this addon.
+func createDebridBenchHandler(conversionClient *realdebrid.Client, availChecks, streams int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		apitoken := mux.Vars(r)["apitoken"]
+
+		ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+		defer cancel()
+
+		availLatency := benchAvailability(ctx, conversionClient, apitoken, availChecks)
+
+		streamURL, err := conversionClient.GetStreamURL(ctx, apitoken, benchHash)
+		if err != nil {
+			log.Println("debridbench: couldn't get stream URL for benchmark hash:", err)
+			http.Error(w, "couldn't unrestrict benchmark hash", http.StatusBadGateway)
+			return
+		}
+
+		ttfb, throughput := benchThroughput(ctx, streamURL, streams)
+
+		report := debridBenchReport{
+			Provider:            "realdebrid",
+			AvailabilityChecks:  availChecks,
+			AvailabilityLatency: availLatency,
+			Streams:             streams,
+			TTFB:                ttfb,
+			ThroughputMBps:      throughput,
+		}
+		log.Printf("debridbench for token %v: %+v\n", apitoken, report)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+	}
+}
+
+// benchAvailability fires n availability checks in parallel against the
+// benchmark hash and returns the latency distribution. Each sample
+// invalidates the cached result first, so it measures a real round trip to
+// RealDebrid instead of a near-0ms cache hit from an earlier run (or from
+// this same token having streamed benchHash before).
+func benchAvailability(ctx context.Context, conversionClient *realdebrid.Client, apitoken string, n int) latencyPercentiles {
+	durations := make([]time.Duration, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := conversionClient.InvalidateAvailability(apitoken, benchHash); err != nil {
+				log.Println("debridbench: couldn't invalidate cached availability result:", err)
+			}
+			start := time.Now()
+			if _, err := conversionClient.CheckInstantAvailability(ctx, apitoken, []string{benchHash}); err != nil {
+				log.Println("debridbench: availability check failed:", err)
+			}
+			durations[i] = time.Since(start)
+		}(i)
+	}
+	wg.Wait()
+	return percentilesOf(durations)
+}
+
+// benchThroughput downloads the first benchRangeBytes of streamURL over n
+// parallel connections, returning the TTFB distribution and the aggregate
+// throughput across all streams.
+func benchThroughput(ctx context.Context, streamURL string, n int) (latencyPercentiles, float64) {
+	ttfbs := make([]time.Duration, n)
+	var totalBytes int64
+	var wg sync.WaitGroup
+
+	start := time.Now()
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			n, ttfb, err := downloadRange(ctx, streamURL, benchRangeBytes)
+			if err != nil {
+				log.Println("debridbench: ranged download failed:", err)
+				return
+			}
+			ttfbs[i] = ttfb
+			atomic.AddInt64(&totalBytes, n)
+		}(i)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	throughputMBps := float64(totalBytes) / (1024 * 1024) / elapsed.Seconds()
+	return percentilesOf(ttfbs), throughputMBps
+}
+
+// benchHTTPClient has no per-request Timeout, unlike http.DefaultClient
+// (which main.go caps at 5s): benchRangeBytes is 8 MiB, so anything slower
+// than ~1.6 MB/s would otherwise abort on a connection that's merely slow,
+// not actually broken. ctx's 30s deadline still bounds the call.
+var benchHTTPClient = &http.Client{}
+
+// downloadRange issues a ranged GET for the first n bytes of url, returning
+// the number of bytes read and the time to first byte.
+func downloadRange(ctx context.Context, url string, n int64) (int64, time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	req.Header.Set("Range", "bytes=0-"+strconv.FormatInt(n-1, 10))
+
+	start := time.Now()
+	resp, err := benchHTTPClient.Do(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer resp.Body.Close()
+
+	buf := make([]byte, 32*1024)
+	read, err := resp.Body.Read(buf)
+	ttfb := time.Since(start)
+	if err != nil && err != io.EOF {
+		return int64(read), ttfb, err
+	}
+
+	rest, err := io.Copy(ioutil.Discard, resp.Body)
+	if err != nil {
+		return int64(read) + rest, ttfb, err
+	}
+	return int64(read) + rest, ttfb, nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+
+	"github.com/doingodswork/deflix-stremio/pkg/btstream"
+	"github.com/doingodswork/deflix-stremio/pkg/cache"
+	"github.com/doingodswork/deflix-stremio/pkg/debrid"
+	"github.com/doingodswork/deflix-stremio/pkg/imdb2torrent"
+)
+
+// contextKey namespaces the values createTokenMiddleware attaches to a
+// request's context, so they can't collide with context keys set elsewhere.
+type contextKey string
+
+// providerTokensContextKey holds the map[string]string of providerKey ->
+// provider-specific token that createTokenMiddleware resolved from the
+// caller's (possibly composite) API token.
+const providerTokensContextKey contextKey = "providerTokens"
+
+// createTokenMiddleware resolves the {apitoken} path segment to every debrid
+// provider the caller configured, validates each resolved token against its
+// provider, and attaches the surviving set to the request context so
+// createStreamHandler can fan out across all of them. A provider whose
+// token fails validation is dropped rather than failing the whole request,
+// so one stale token in a composite "rd:x+ad:y" doesn't lock the user out
+// of the providers that still work; only an empty result is a 401.
+func createTokenMiddleware(providers map[string]debrid.Client) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			apitoken := mux.Vars(r)["apitoken"]
+			if apitoken == "" {
+				http.Error(w, "missing API token", http.StatusUnauthorized)
+				return
+			}
+
+			providerTokens := parseProviderTokens(apitoken, providers)
+			for providerKey, token := range providerTokens {
+				if err := providers[providerKey].ValidateToken(r.Context(), token); err != nil {
+					log.Println("Invalid API token for provider", providerKey, ":", err)
+					delete(providerTokens, providerKey)
+				}
+			}
+			if len(providerTokens) == 0 {
+				http.Error(w, "invalid API token", http.StatusUnauthorized)
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), providerTokensContextKey, providerTokens)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// createManifestHandler serves the Stremio addon manifest. providers is
+// accepted for parity with the other Stremio handlers, which all dispatch on
+// it; the manifest itself is the same regardless of which provider the
+// caller's token resolves to.
+func createManifestHandler(providers map[string]debrid.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(manifest)
+	}
+}
+
+// streamEntry is the subset of a Stremio stream object this addon fills in.
+type streamEntry struct {
+	Name  string `json:"name"`
+	Title string `json:"title"`
+	URL   string `json:"url"`
+}
+
+// availabilityResult is one provider's answer to a batch CheckInstantAvailability call.
+type availabilityResult struct {
+	providerKey string
+	available   map[string]bool
+}
+
+// createStreamHandler searches for torrents via searchClient, fans out
+// availability checks across every debrid provider the caller configured,
+// and returns one stream entry per torrent per provider that has it cached,
+// falling back to a single "P2P (direct)" entry for torrents none of them do.
+func createStreamHandler(searchClient *imdb2torrent.Client, providers map[string]debrid.Client, btClient *btstream.Client, redirectCache *cache.Cache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		imdbID := strings.TrimSuffix(mux.Vars(r)["id"], ".json")
+		providerTokens, _ := r.Context().Value(providerTokensContextKey).(map[string]string)
+
+		torrents, err := searchClient.FindMovie(r.Context(), imdbID)
+		if err != nil {
+			log.Println("Couldn't find torrents for", imdbID, ":", err)
+			http.Error(w, "couldn't find torrents", http.StatusInternalServerError)
+			return
+		}
+
+		hashes := make([]string, len(torrents))
+		for i, t := range torrents {
+			hashes[i] = t.InfoHash
+		}
+
+		results := make(chan availabilityResult, len(providerTokens))
+		var wg sync.WaitGroup
+		for providerKey, token := range providerTokens {
+			wg.Add(1)
+			go func(providerKey, token string) {
+				defer wg.Done()
+				available, err := providers[providerKey].CheckInstantAvailability(r.Context(), token, hashes)
+				if err != nil {
+					log.Println("Availability check failed for provider", providerKey, ":", err)
+					return
+				}
+				results <- availabilityResult{providerKey: providerKey, available: available}
+			}(providerKey, token)
+		}
+		go func() {
+			wg.Wait()
+			close(results)
+		}()
+
+		availableByProvider := make(map[string]map[string]bool, len(providerTokens))
+		for res := range results {
+			availableByProvider[res.providerKey] = res.available
+		}
+
+		streams := make([]streamEntry, 0, len(torrents))
+		for _, t := range torrents {
+			cached := false
+			for providerKey, available := range availableByProvider {
+				if !available[t.InfoHash] {
+					continue
+				}
+				cached = true
+
+				provider := providers[providerKey]
+				streamURL, err := provider.GetStreamURL(r.Context(), providerTokens[providerKey], t.InfoHash)
+				if err != nil {
+					log.Println("Couldn't get stream URL from", provider.Name(), "for", t.InfoHash, ":", err)
+					continue
+				}
+				redirectID, err := newRedirectID(redirectCache, streamURL)
+				if err != nil {
+					log.Println("Couldn't persist redirect ID for", t.InfoHash, ":", err)
+					continue
+				}
+				streams = append(streams, streamEntry{
+					Name:  provider.Name(),
+					Title: t.Title,
+					URL:   streamURLaddr + "/redirect/" + redirectID,
+				})
+			}
+			if !cached {
+				streams = append(streams, streamEntry{
+					Name:  "P2P (direct)",
+					Title: t.Title,
+					URL:   streamURLaddr + "/btstream/" + t.InfoHash,
+				})
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string][]streamEntry{"streams": streams})
+	}
+}
+
+// newRedirectID stores streamURL under a fresh random ID in redirectCache
+// and returns that ID, so Stremio only ever sees short-lived opaque URLs
+// instead of a debrid provider's direct, token-bearing links. Returns an
+// error if the ID couldn't be persisted, since handing it out anyway would
+// advertise a stream that 404s at /redirect/{id}.
+func newRedirectID(redirectCache *cache.Cache, streamURL string) (string, error) {
+	b := make([]byte, 16)
+	rand.Read(b)
+	id := hex.EncodeToString(b)
+	if err := redirectCache.Set(id, []byte(streamURL)); err != nil {
+		return "", err
+	}
+	return id, nil
+}
@@ -8,19 +8,32 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
-	"runtime"
 	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
-	"github.com/VictoriaMetrics/fastcache"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
+	"golang.org/x/time/rate"
 
+	"github.com/doingodswork/deflix-stremio/pkg/btstream"
+	"github.com/doingodswork/deflix-stremio/pkg/cache"
+	"github.com/doingodswork/deflix-stremio/pkg/debrid"
+	"github.com/doingodswork/deflix-stremio/pkg/debrid/alldebrid"
 	"github.com/doingodswork/deflix-stremio/pkg/imdb2torrent"
 	"github.com/doingodswork/deflix-stremio/pkg/realdebrid"
 	"github.com/doingodswork/deflix-stremio/pkg/stremio"
+	"github.com/doingodswork/deflix-stremio/pkg/transcode"
+)
+
+// Cache entry TTLs. Availability and redirect entries churn fast on the
+// debrid side; tokens and torrent search results stay valid much longer.
+const (
+	availabilityCacheTTL = time.Hour
+	tokenCacheTTL        = 24 * time.Hour
+	torrentCacheTTL      = 24 * time.Hour
+	redirectCacheTTL     = time.Hour
 )
 
 const (
@@ -29,20 +42,57 @@ const (
 
 // Flags
 var (
-	bindAddr      = *flag.String("bindAddr", "localhost", "Local interface address to bind to. \"0.0.0.0\" binds to all interfaces.")
-	port          = *flag.Int("port", 8080, "Port to listen on")
-	streamURLaddr = *flag.String("streamURLaddr", "http://localhost:8080", "Address to be used in a stream URL that's delivered to Stremio and later used to redirect to RealDebrid")
-	cachePath     = *flag.String("cachePath", "", "Path for loading a persisted cache on startup and persisting the current cache in regular intervals. An empty value will lead to `os.UserCacheDir()+\"/deflix-stremio/\"`")
-	// 128*1024*1024 are 128 MB
-	// We split these on 4 caches à 32 MB
-	// Note: fastcache uses 32 MB as minimum, that's why we use `4*32 MB = 128 MB` as minimum.
-	cacheMaxBytes = *flag.Int("cacheMaxBytes", 128*1024*1024, "Max number of bytes to be used for the in-memory cache. Default (and minimum!) is 128 MB.")
+	bindAddr               string
+	port                   int
+	streamURLaddr          string
+	cachePath              string
+	rateLimit              float64
+	rateBurst              int
+	rateTTL                time.Duration
+	btMaxTorrents          int
+	btCacheBytes           int64
+	btDataDir              string
+	btDHTNodes             string
+	btEnablePEX            bool
+	btEnableUTP            bool
+	btEnableEnc            bool
+	btIdleTimeout          time.Duration
+	hwAccel                string
+	transcodeMaxConcurrent int
+	transcodeTempDir       string
+	transcodeIdleTimeout   time.Duration
+	debridBenchChecks      int
+	debridBenchStreams     int
 )
 
+func init() {
+	flag.StringVar(&bindAddr, "bindAddr", "localhost", "Local interface address to bind to. \"0.0.0.0\" binds to all interfaces.")
+	flag.IntVar(&port, "port", 8080, "Port to listen on")
+	flag.StringVar(&streamURLaddr, "streamURLaddr", "http://localhost:8080", "Address to be used in a stream URL that's delivered to Stremio and later used to redirect to RealDebrid")
+	flag.StringVar(&cachePath, "cachePath", "", "Directory whose \"cache\" subdirectory holds the persistent cache database. An empty value will lead to `os.UserCacheDir()+\"/deflix-stremio/\"`")
+	flag.Float64Var(&rateLimit, "rateLimit", 1, "Max number of requests per second, per API token (or remote IP for the redirect handler), to upstream-hitting endpoints")
+	flag.IntVar(&rateBurst, "rateBurst", 5, "Max burst size, in requests, allowed on top of the steady rateLimit")
+	flag.DurationVar(&rateTTL, "rateTTL", 10*time.Minute, "Idle time after which a source's rate limiter is forgotten, so the limiter map stays bounded")
+	flag.IntVar(&btMaxTorrents, "btMaxTorrents", 20, "Max number of torrents to join concurrently for direct P2P streaming")
+	flag.Int64Var(&btCacheBytes, "btCacheBytes", 10*1024*1024*1024, "Max number of bytes on disk to use for direct P2P streaming's torrent data")
+	flag.StringVar(&btDataDir, "btDataDir", "", "Directory for direct P2P streaming's torrent data. An empty value will lead to `os.UserCacheDir()+\"/deflix-stremio/torrents\"`")
+	flag.StringVar(&btDHTNodes, "btDHTNodes", "", "Comma-separated list of additional DHT bootstrap nodes for direct P2P streaming")
+	flag.BoolVar(&btEnablePEX, "btEnablePEX", true, "Enable peer exchange for direct P2P streaming")
+	flag.BoolVar(&btEnableUTP, "btEnableUTP", true, "Enable the uTP transport (in addition to TCP) for direct P2P streaming")
+	flag.BoolVar(&btEnableEnc, "btEnableEncryption", true, "Prefer obfuscated connections for direct P2P streaming")
+	flag.DurationVar(&btIdleTimeout, "btIdleTimeout", 10*time.Minute, "Idle time, with no active reader, after which a direct P2P stream's torrent is dropped and its data removed")
+	flag.StringVar(&hwAccel, "hwAccel", "none", "Hardware-accelerated encoder to use for transcoding: \"none\", \"vaapi\" or \"nvenc\"")
+	flag.IntVar(&transcodeMaxConcurrent, "transcodeMaxConcurrent", 2, "Max number of concurrent ffmpeg transcodes")
+	flag.StringVar(&transcodeTempDir, "transcodeTempDir", "", "Directory for transcoding's temporary HLS segments. An empty value will lead to `os.TempDir()+\"/deflix-stremio/transcode\"`")
+	flag.DurationVar(&transcodeIdleTimeout, "transcodeIdleTimeout", 2*time.Minute, "Idle time, with no requests, after which a transcode session's ffmpeg process is killed and its temp dir removed")
+	flag.IntVar(&debridBenchChecks, "debridBenchChecks", 20, "Number of parallel availability checks /debridbench performs")
+	flag.IntVar(&debridBenchStreams, "debridBenchStreams", 4, "Number of parallel download streams /debridbench performs")
+}
+
 var manifest = stremio.Manifest{
 	ID:          "tv.deflix.stremio",
 	Name:        "Deflix - Debrid flicks",
-	Description: "Automatically turns torrents into debrid/cached streams, for high speed and no seeding. Currently supported providers: real-debrid.com (more coming soon™).",
+	Description: "Automatically turns torrents into debrid/cached streams, for high speed and no seeding. Currently supported providers: real-debrid.com, alldebrid.com (more coming soon™).",
 	Version:     version,
 
 	ResourceItems: []stremio.ResourceItem{
@@ -63,13 +113,15 @@ var manifest = stremio.Manifest{
 	Logo:       "https://www.deflix.tv/images/Logo-250px.png",
 }
 
-// In-memory cache, which is filled from a file on startup and persisted to a file in regular intervals.
-// Use four different caches so that for example a high churn (new entries pushing out old ones) in the torrent cache doesn't lead to important redirect entries to be lost before used by the user.
+// Persistent cache, backed by a single Badger database split into keyspaces
+// so that for example a high churn (new entries pushing out old ones) in the
+// torrent cache can't evict important redirect entries before they're used.
 var (
-	torrentCache      *fastcache.Cache
-	tokenCache        *fastcache.Cache
-	availabilityCache *fastcache.Cache
-	redirectCache     *fastcache.Cache
+	cacheDB           *cache.DB
+	torrentCache      *cache.Cache
+	tokenCache        *cache.Cache
+	availabilityCache *cache.Cache
+	redirectCache     *cache.Cache
 )
 
 func init() {
@@ -83,7 +135,7 @@ func init() {
 func main() {
 	flag.Parse()
 
-	// Load or create caches
+	// Open the persistent cache
 
 	if cachePath == "" {
 		userCacheDir, err := os.UserCacheDir()
@@ -95,10 +147,15 @@ func main() {
 		cachePath = strings.TrimSuffix(cachePath, "/")
 	}
 	cachePath += "/cache"
-	tokenCache = fastcache.LoadFromFileOrNew(cachePath+"/token", cacheMaxBytes/4)
-	availabilityCache = fastcache.LoadFromFileOrNew(cachePath+"/availability", cacheMaxBytes/4)
-	torrentCache = fastcache.LoadFromFileOrNew(cachePath+"/torrent", cacheMaxBytes/4)
-	redirectCache = fastcache.LoadFromFileOrNew(cachePath+"/redirect", cacheMaxBytes/4)
+	var err error
+	cacheDB, err = cache.Open(cachePath)
+	if err != nil {
+		log.Fatal("Couldn't open cache:", err)
+	}
+	tokenCache = cacheDB.Keyspace("token", tokenCacheTTL)
+	availabilityCache = cacheDB.Keyspace("availability", availabilityCacheTTL)
+	torrentCache = cacheDB.Keyspace("torrent", torrentCacheTTL)
+	redirectCache = cacheDB.Keyspace("redirect", redirectCacheTTL)
 
 	// Basic middleware and health endpoint
 
@@ -112,25 +169,88 @@ func main() {
 		loggingMiddleware)
 	s.HandleFunc("/health", healthHandler)
 
+	// Endpoints that hit upstream services (RealDebrid, torrent sites) also get rate-limited per source, so a
+	// single misconfigured client can't burn through our upstream quotas.
+	limiterStore := newRateLimiterStore(rate.Limit(rateLimit), rateBurst, rateTTL)
+	limited := r.Methods("GET").Subrouter()
+	limited.Use(timerMiddleware,
+		corsMiddleware,
+		handlers.ProxyHeaders,
+		recoveryMiddleware,
+		loggingMiddleware,
+		rateLimitMiddleware(limiterStore))
+
 	// Stremio endpoints
 
 	conversionClient := realdebrid.NewClient(5*time.Second, tokenCache, availabilityCache)
 	searchClient := imdb2torrent.NewClient(5*time.Second, torrentCache)
+
+	// Debrid providers. The API token's "rd:"/"ad:" prefix (handled by
+	// createTokenMiddleware) selects which of these backs a given request.
+	debridProviders := map[string]debrid.Client{
+		"rd": conversionClient,
+		"ad": alldebrid.NewClient(5*time.Second, tokenCache, availabilityCache),
+	}
+
+	// Direct P2P streaming, used as a fallback when a torrent's hash isn't cached on the debrid side.
+	if btDataDir == "" {
+		userCacheDir, err := os.UserCacheDir()
+		if err != nil {
+			log.Fatal("Couldn't determine user cache directory via `os.UserCacheDir()`:", err)
+		}
+		btDataDir = userCacheDir + "/deflix-stremio/torrents"
+	}
+	var btBootstrapNodes []string
+	if btDHTNodes != "" {
+		btBootstrapNodes = strings.Split(btDHTNodes, ",")
+	}
+	btClient, err := btstream.NewClient(btstream.Config{
+		DataDir:           btDataDir,
+		MaxTorrents:       btMaxTorrents,
+		MaxCacheBytes:     btCacheBytes,
+		DHTBootstrapNodes: btBootstrapNodes,
+		EnablePEX:         btEnablePEX,
+		EnableUTP:         btEnableUTP,
+		EnableEncryption:  btEnableEnc,
+		IdleTimeout:       btIdleTimeout,
+	})
+	if err != nil {
+		log.Fatal("Couldn't create direct P2P streaming client:", err)
+	}
+
 	// Use token middleware only for the Stremio endpoints
-	tokenMiddleware := createTokenMiddleware(conversionClient)
-	manifestHandler := createManifestHandler(conversionClient)
-	streamHandler := createStreamHandler(searchClient, conversionClient, redirectCache)
-	s.HandleFunc("/{apitoken}/manifest.json", tokenMiddleware(manifestHandler).ServeHTTP)
-	s.HandleFunc("/{apitoken}/stream/{type}/{id}.json", tokenMiddleware(streamHandler).ServeHTTP)
+	tokenMiddleware := createTokenMiddleware(debridProviders)
+	manifestHandler := createManifestHandler(debridProviders)
+	streamHandler := createStreamHandler(searchClient, debridProviders, btClient, redirectCache)
+	limited.HandleFunc("/{apitoken}/manifest.json", tokenMiddleware(manifestHandler).ServeHTTP)
+	limited.HandleFunc("/{apitoken}/stream/{type}/{id}.json", tokenMiddleware(streamHandler).ServeHTTP)
 
 	// Additional endpoints
 
 	// Redirects stream URLs (previously sent to Stremio) to the actual RealDebrid stream URLs
-	s.HandleFunc("/redirect/{id}", createRedirectHandler(redirectCache, conversionClient))
+	limited.HandleFunc("/redirect/{id}", createRedirectHandler(redirectCache, conversionClient))
+	// Serves a torrent's largest file directly over HTTP, for when debrid doesn't have it cached
+	limited.HandleFunc("/btstream/{infohash}", createBTStreamHandler(btClient))
+
+	// On-the-fly transcoding for clients that can't play the source codec
+	if transcodeTempDir == "" {
+		transcodeTempDir = os.TempDir() + "/deflix-stremio/transcode"
+	}
+	transcoder := transcode.NewTranscoder(transcode.Config{
+		HWAccel:       transcode.HWAccel(hwAccel),
+		MaxConcurrent: transcodeMaxConcurrent,
+	})
+	transcodeSessions := newTranscodeSessions(transcodeTempDir, transcodeIdleTimeout)
+	transcodeHandler := createTranscodeHandler(redirectCache, transcoder, transcodeSessions)
+	limited.HandleFunc("/transcode/{id}", transcodeHandler)
+	limited.HandleFunc("/transcode/{id}/{file}", transcodeHandler)
+
+	// Lets operators diagnose whether slow playback is caused by the debrid provider or by this addon
+	limited.HandleFunc("/debridbench/{apitoken}", createDebridBenchHandler(conversionClient, debridBenchChecks, debridBenchStreams))
 
 	srv := &http.Server{
 		Addr:    bindAddr + ":" + strconv.Itoa(port),
-		Handler: s,
+		Handler: r,
 		// Timeouts to avoid Slowloris attacks
 		ReadTimeout:    time.Second * 5,
 		WriteTimeout:   time.Second * 15,
@@ -138,9 +258,6 @@ func main() {
 		MaxHeaderBytes: 1 << 10, // 1 KB
 	}
 
-	stopping := false
-	stoppingPtr := &stopping
-
 	log.Println("Starting server")
 	go func() {
 		if err := srv.ListenAndServe(); err != nil {
@@ -156,32 +273,16 @@ func main() {
 		}
 	}()
 
-	// Save cache to file every hour
+	// Print cache stats every hour. Badger persists durably on every write, so unlike the old fastcache
+	// instances this no longer doubles as the only way to not lose the cache on a non-graceful exit.
 	go func() {
-		for {
-			time.Sleep(time.Hour)
-			persistCache(cachePath, stoppingPtr)
-		}
-	}()
-
-	// Print cache stats every hour
-	go func() {
-		// Don't run at the same time as the persistence
 		time.Sleep(time.Minute)
-		stats := fastcache.Stats{}
 		for {
-			tokenCache.UpdateStats(&stats)
-			log.Printf("Token cache stats: %#v\n", stats)
-			stats.Reset()
-			availabilityCache.UpdateStats(&stats)
-			log.Printf("Availability cache stats: %#v\n", stats)
-			stats.Reset()
-			torrentCache.UpdateStats(&stats)
-			log.Printf("Torrent cache stats: %#v\n", stats)
-			stats.Reset()
-			redirectCache.UpdateStats(&stats)
-			log.Printf("Redirect cache stats: %#v\n", stats)
-			stats.Reset()
+			logCacheStats("Token", tokenCache)
+			logCacheStats("Availability", availabilityCache)
+			logCacheStats("Torrent", torrentCache)
+			logCacheStats("Redirect", redirectCache)
+			log.Printf("Cache size on disk: %v bytes\n", cacheDB.SizeOnDisk())
 
 			time.Sleep(time.Hour)
 		}
@@ -194,7 +295,6 @@ func main() {
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	sig := <-c
 	log.Printf("Received \"%v\" signal. Shutting down...\n", sig)
-	*stoppingPtr = true
 	// Create a deadline to wait for.
 	// Using the same value as the server's `WriteTimeout` would be great, because this would mean that every client could finish his request as he normally could.
 	// But `docker stop` only gives us 10 seconds.
@@ -204,26 +304,15 @@ func main() {
 	if err := srv.Shutdown(ctx); err != nil {
 		log.Fatal("Error shutting down server:", err)
 	}
-}
-
-func persistCache(cacheFilePath string, stoppingPtr *bool) {
-	if *stoppingPtr {
-		log.Println("Regular cache persistence triggered, but server is shutting down")
-		return
+	btClient.Close()
+	if err := cacheDB.Close(); err != nil {
+		log.Println("Couldn't close cache:", err)
 	}
+}
 
-	log.Printf("Persisting caches to \"%v\"...\n", cacheFilePath)
-	if err := tokenCache.SaveToFileConcurrent(cacheFilePath+"/token", runtime.NumCPU()); err != nil {
-		log.Println("Couldn't save token cache to file:", err)
-	}
-	if err := availabilityCache.SaveToFileConcurrent(cacheFilePath+"/availability", runtime.NumCPU()); err != nil {
-		log.Println("Couldn't save availability cache to file:", err)
-	}
-	if err := torrentCache.SaveToFileConcurrent(cacheFilePath+"/torrent", runtime.NumCPU()); err != nil {
-		log.Println("Couldn't save torrent cache to file:", err)
-	}
-	if err := redirectCache.SaveToFileConcurrent(cacheFilePath+"/redirect", runtime.NumCPU()); err != nil {
-		log.Println("Couldn't save redirect cache to file:", err)
-	}
-	log.Println("Persisted caches")
+// logCacheStats logs the entry count and cumulative hit/miss counters for a
+// cache keyspace, identified by name in the log line.
+func logCacheStats(name string, c *cache.Cache) {
+	hits, misses := c.Stats()
+	log.Printf("%v cache stats: entries=%v hits=%v misses=%v\n", name, c.Len(), hits, misses)
 }
@@ -0,0 +1,268 @@
+// Package btstream serves a torrent's largest video file directly over HTTP
+// by joining the BitTorrent swarm, for use as a fallback stream when a debrid
+// provider doesn't have the hash cached yet.
+package btstream
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// Config configures the torrent client and how aggressively idle torrents are
+// cleaned up again.
+type Config struct {
+	// DataDir is where downloaded pieces are cached on disk.
+	DataDir string
+	// MaxTorrents caps the number of torrents joined concurrently.
+	MaxTorrents int
+	// MaxCacheBytes caps the total disk space used by DataDir.
+	MaxCacheBytes int64
+	// DHTBootstrapNodes seeds the DHT, in addition to anacrolix/torrent's defaults.
+	DHTBootstrapNodes []string
+	// EnablePEX toggles peer exchange.
+	EnablePEX bool
+	// EnableUTP toggles the uTP transport, in addition to TCP.
+	EnableUTP bool
+	// EnableEncryption requires/prefers obfuscated connections.
+	EnableEncryption bool
+	// IdleTimeout is how long a torrent is kept around without an active reader before it's dropped.
+	IdleTimeout time.Duration
+}
+
+// Client joins BitTorrent swarms on demand and serves the largest file of
+// each torrent over HTTP, reaping torrents that nobody is reading from.
+type Client struct {
+	torrentClient *torrent.Client
+	cfg           Config
+
+	mu       sync.Mutex
+	tracked  map[string]*trackedTorrent
+	stopReap chan struct{}
+}
+
+// trackedTorrent records how many HTTP readers are currently attached to a
+// torrent, so the reaper knows when it's safe to drop.
+type trackedTorrent struct {
+	t          *torrent.Torrent
+	readers    int
+	lastActive time.Time
+}
+
+// NewClient creates a torrent client and starts the idle-torrent reaper.
+func NewClient(cfg Config) (*Client, error) {
+	tcfg := torrent.NewDefaultClientConfig()
+	tcfg.DataDir = cfg.DataDir
+	tcfg.DisablePEX = !cfg.EnablePEX
+	tcfg.DisableUTP = !cfg.EnableUTP
+	tcfg.DisableEncryption = !cfg.EnableEncryption
+	if len(cfg.DHTBootstrapNodes) > 0 {
+		tcfg.DhtStartingNodes = dhtBootstrapNodes(tcfg.DhtStartingNodes, cfg.DHTBootstrapNodes)
+	}
+
+	torrentClient, err := torrent.NewClient(tcfg)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create torrent client: %w", err)
+	}
+
+	c := &Client{
+		torrentClient: torrentClient,
+		cfg:           cfg,
+		tracked:       make(map[string]*trackedTorrent),
+		stopReap:      make(chan struct{}),
+	}
+	go c.reapLoop()
+	return c, nil
+}
+
+// Close shuts down the torrent client and stops the reaper.
+func (c *Client) Close() {
+	close(c.stopReap)
+	c.torrentClient.Close()
+}
+
+// ServeContent joins the swarm for infohash (if not already joined), waits
+// for torrent metadata, and streams the largest file to w as a seekable
+// ranged response via http.ServeContent.
+func (c *Client) ServeContent(w http.ResponseWriter, r *http.Request, infohash string) error {
+	t, err := c.getOrAddTorrent(infohash)
+	if err != nil {
+		return err
+	}
+
+	// Mark infohash as having an active reader before blocking on GotInfo,
+	// not just while serving: otherwise a torrent that's slow to resolve
+	// metadata (a real possibility for rare/poorly-seeded swarms) still has
+	// readers == 0 and can be reaped by reapIdle out from under this
+	// in-flight request.
+	c.touch(infohash, 1)
+	defer c.touch(infohash, -1)
+
+	select {
+	case <-t.GotInfo():
+	case <-r.Context().Done():
+		return r.Context().Err()
+	}
+
+	file := largestFile(t)
+	reader := file.NewReader()
+	defer reader.Close()
+	reader.SetResponsive()
+
+	http.ServeContent(w, r, file.DisplayPath(), time.Time{}, reader)
+	return nil
+}
+
+func (c *Client) getOrAddTorrent(infohash string) (*torrent.Torrent, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if tt, ok := c.tracked[infohash]; ok {
+		tt.lastActive = time.Now()
+		return tt.t, nil
+	}
+
+	if len(c.tracked) >= c.cfg.MaxTorrents {
+		return nil, fmt.Errorf("max concurrent torrents (%d) reached", c.cfg.MaxTorrents)
+	}
+
+	hash, err := parseInfohash(infohash)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't join swarm for %v: %w", infohash, err)
+	}
+	t, _ := c.torrentClient.AddTorrentInfoHash(hash)
+	t.DownloadAll()
+	c.tracked[infohash] = &trackedTorrent{t: t, lastActive: time.Now()}
+	return t, nil
+}
+
+// touch adjusts the active-reader count for infohash and bumps lastActive.
+func (c *Client) touch(infohash string, delta int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if tt, ok := c.tracked[infohash]; ok {
+		tt.readers += delta
+		tt.lastActive = time.Now()
+	}
+}
+
+// reapLoop periodically drops torrents that have had no active reader for
+// longer than cfg.IdleTimeout, keeping disk usage bounded.
+func (c *Client) reapLoop() {
+	ticker := time.NewTicker(c.cfg.IdleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.reapIdle()
+		case <-c.stopReap:
+			return
+		}
+	}
+}
+
+func (c *Client) reapIdle() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cutoff := time.Now().Add(-c.cfg.IdleTimeout)
+	for infohash, tt := range c.tracked {
+		if tt.readers == 0 && tt.lastActive.Before(cutoff) {
+			tt.t.Drop()
+			delete(c.tracked, infohash)
+		}
+	}
+
+	c.enforceDiskCapLocked()
+}
+
+// enforceDiskCapLocked drops idle torrents, least-recently-active first,
+// until total disk usage is back under cfg.MaxCacheBytes. Torrents with an
+// active reader are never evicted, even if that means staying over the cap;
+// callers must hold c.mu.
+func (c *Client) enforceDiskCapLocked() {
+	if c.cfg.MaxCacheBytes <= 0 {
+		return
+	}
+
+	var total int64
+	for _, tt := range c.tracked {
+		total += tt.t.BytesCompleted()
+	}
+	if total <= c.cfg.MaxCacheBytes {
+		return
+	}
+
+	type evictable struct {
+		infohash string
+		tt       *trackedTorrent
+	}
+	var candidates []evictable
+	for infohash, tt := range c.tracked {
+		if tt.readers == 0 {
+			candidates = append(candidates, evictable{infohash, tt})
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].tt.lastActive.Before(candidates[j].tt.lastActive)
+	})
+
+	for _, cand := range candidates {
+		if total <= c.cfg.MaxCacheBytes {
+			return
+		}
+		total -= cand.tt.t.BytesCompleted()
+		cand.tt.t.Drop()
+		delete(c.tracked, cand.infohash)
+	}
+}
+
+// parseInfohash validates and parses a hex-encoded infohash, as used
+// throughout imdb2torrent and realdebrid, into the type the torrent client
+// expects. AddTorrentInfoHash itself has no way to reject a malformed hash,
+// so we check it ourselves first.
+func parseInfohash(infohash string) (metainfo.Hash, error) {
+	b, err := hex.DecodeString(infohash)
+	if err != nil {
+		return metainfo.Hash{}, fmt.Errorf("invalid infohash: %w", err)
+	}
+	if len(b) != metainfo.HashSize {
+		return metainfo.Hash{}, fmt.Errorf("invalid infohash length: got %d bytes, want %d", len(b), metainfo.HashSize)
+	}
+	var hash metainfo.Hash
+	copy(hash[:], b)
+	return hash, nil
+}
+
+// dhtBootstrapNodes wraps the torrent client's default bootstrap-node getter
+// so our configured nodes are added on top of its defaults instead of
+// replacing them.
+func dhtBootstrapNodes(defaultGetter func(network string) ([]string, error), nodes []string) func(network string) ([]string, error) {
+	return func(network string) ([]string, error) {
+		var defaults []string
+		if defaultGetter != nil {
+			var err error
+			defaults, err = defaultGetter(network)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return append(defaults, nodes...), nil
+	}
+}
+
+// largestFile returns the biggest file in the torrent, which is almost
+// always the actual video file amongst samples, NFOs and subtitles.
+func largestFile(t *torrent.Torrent) *torrent.File {
+	files := t.Files()
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Length() > files[j].Length()
+	})
+	return files[0]
+}
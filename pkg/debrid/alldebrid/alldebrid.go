@@ -0,0 +1,197 @@
+// Package alldebrid implements pkg/debrid.Client against the AllDebrid API
+// (https://docs.alldebrid.com), as a second debrid provider alongside
+// RealDebrid.
+package alldebrid
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/doingodswork/deflix-stremio/pkg/cache"
+)
+
+const baseURL = "https://api.alldebrid.com/v4"
+
+// Client implements debrid.Client against the AllDebrid API. It caches
+// availability results the same way pkg/realdebrid does, so repeated
+// CheckInstantAvailability calls for the same token/hash are cheap.
+type Client struct {
+	httpClient        *http.Client
+	tokenCache        *cache.Cache
+	availabilityCache *cache.Cache
+}
+
+// NewClient creates an AllDebrid client, mirroring realdebrid.NewClient's
+// signature so the two can be constructed the same way in main.go.
+func NewClient(timeout time.Duration, tokenCache, availabilityCache *cache.Cache) *Client {
+	return &Client{
+		httpClient:        &http.Client{Timeout: timeout},
+		tokenCache:        tokenCache,
+		availabilityCache: availabilityCache,
+	}
+}
+
+func (c *Client) Name() string {
+	return "ad"
+}
+
+func (c *Client) ValidateToken(ctx context.Context, apitoken string) error {
+	if _, ok := c.tokenCache.Get(apitoken); ok {
+		return nil
+	}
+
+	var res struct {
+		Status string `json:"status"`
+		Error  *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := c.get(ctx, "/user", apitoken, nil, &res); err != nil {
+		return err
+	}
+	if res.Status != "success" {
+		msg := "unknown error"
+		if res.Error != nil {
+			msg = res.Error.Message
+		}
+		return fmt.Errorf("alldebrid: invalid token: %v", msg)
+	}
+
+	if err := c.tokenCache.Set(apitoken, []byte{1}); err != nil {
+		log.Println("alldebrid: couldn't cache token validation result:", err)
+	}
+	return nil
+}
+
+func (c *Client) CheckInstantAvailability(ctx context.Context, apitoken string, infohashes []string) (map[string]bool, error) {
+	result := make(map[string]bool, len(infohashes))
+
+	uncached := make([]string, 0, len(infohashes))
+	for _, hash := range infohashes {
+		if cached, ok := c.availabilityCache.Get(apitoken + hash); ok {
+			result[hash] = len(cached) > 0 && cached[0] == 1
+		} else {
+			uncached = append(uncached, hash)
+		}
+	}
+	if len(uncached) == 0 {
+		return result, nil
+	}
+
+	params := url.Values{}
+	for _, hash := range uncached {
+		params.Add("magnets[]", hash)
+	}
+	var res struct {
+		Status string `json:"status"`
+		Data   struct {
+			Magnets []struct {
+				Hash  string `json:"hash"`
+				Ready bool   `json:"instant"`
+			} `json:"magnets"`
+		} `json:"data"`
+	}
+	if err := c.get(ctx, "/magnet/instant", apitoken, params, &res); err != nil {
+		return nil, err
+	}
+	if res.Status != "success" {
+		return nil, fmt.Errorf("alldebrid: instant availability check failed")
+	}
+
+	for _, magnet := range res.Data.Magnets {
+		result[magnet.Hash] = magnet.Ready
+		var flag byte
+		if magnet.Ready {
+			flag = 1
+		}
+		if err := c.availabilityCache.Set(apitoken+magnet.Hash, []byte{flag}); err != nil {
+			log.Println("alldebrid: couldn't cache availability result:", err)
+		}
+	}
+	return result, nil
+}
+
+func (c *Client) GetStreamURL(ctx context.Context, apitoken, infohash string) (string, error) {
+	params := url.Values{}
+	params.Set("magnet", infohash)
+	var uploadRes struct {
+		Status string `json:"status"`
+		Data   struct {
+			Magnets []struct {
+				ID int `json:"id"`
+			} `json:"magnets"`
+		} `json:"data"`
+	}
+	if err := c.get(ctx, "/magnet/upload", apitoken, params, &uploadRes); err != nil {
+		return "", err
+	}
+	if uploadRes.Status != "success" || len(uploadRes.Data.Magnets) == 0 {
+		return "", fmt.Errorf("alldebrid: couldn't upload magnet for %v", infohash)
+	}
+
+	linkParams := url.Values{}
+	linkParams.Set("id", fmt.Sprint(uploadRes.Data.Magnets[0].ID))
+	var statusRes struct {
+		Status string `json:"status"`
+		Data   struct {
+			Magnets struct {
+				Links []struct {
+					Link string `json:"link"`
+				} `json:"links"`
+			} `json:"magnets"`
+		} `json:"data"`
+	}
+	if err := c.get(ctx, "/magnet/status", apitoken, linkParams, &statusRes); err != nil {
+		return "", err
+	}
+	if statusRes.Status != "success" || len(statusRes.Data.Magnets.Links) == 0 {
+		return "", fmt.Errorf("alldebrid: no ready link for %v", infohash)
+	}
+
+	unlockParams := url.Values{}
+	unlockParams.Set("link", statusRes.Data.Magnets.Links[0].Link)
+	var unlockRes struct {
+		Status string `json:"status"`
+		Data   struct {
+			Link string `json:"link"`
+		} `json:"data"`
+	}
+	if err := c.get(ctx, "/link/unlock", apitoken, unlockParams, &unlockRes); err != nil {
+		return "", err
+	}
+	if unlockRes.Status != "success" {
+		return "", fmt.Errorf("alldebrid: couldn't unlock link for %v", infohash)
+	}
+	return unlockRes.Data.Link, nil
+}
+
+// get issues a GET request against the AllDebrid API and decodes the JSON
+// response into out.
+func (c *Client) get(ctx context.Context, path, apitoken string, params url.Values, out interface{}) error {
+	if params == nil {
+		params = url.Values{}
+	}
+	params.Set("agent", "deflix-stremio")
+	params.Set("apikey", apitoken)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, baseURL+path+"?"+params.Encode(), nil)
+	if err != nil {
+		return fmt.Errorf("couldn't create AllDebrid request: %w", err)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("AllDebrid request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("couldn't decode AllDebrid response: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,22 @@
+// Package debrid defines the provider-agnostic interface the addon talks to,
+// so new debrid services can be added without touching the Stremio-facing
+// handlers in main.go.
+package debrid
+
+import "context"
+
+// Client is implemented by each supported debrid provider (e.g. RealDebrid,
+// AllDebrid). All methods take the user's provider-specific API token, not
+// the composite "prefix:token" the addon exposes to Stremio.
+type Client interface {
+	// Name is the provider key used in the composite API token (e.g. "rd", "ad")
+	// and in the Stremio stream labels.
+	Name() string
+	// ValidateToken checks that apitoken is accepted by the provider.
+	ValidateToken(ctx context.Context, apitoken string) error
+	// CheckInstantAvailability returns, for the subset of infohashes the
+	// provider has instantly available, true.
+	CheckInstantAvailability(ctx context.Context, apitoken string, infohashes []string) (map[string]bool, error)
+	// GetStreamURL resolves infohash to a playable URL for apitoken.
+	GetStreamURL(ctx context.Context, apitoken, infohash string) (string, error)
+}
@@ -0,0 +1,91 @@
+// Package imdb2torrent looks up torrents for a movie's IMDb ID, so the
+// addon can hand their infohashes to a debrid provider or to pkg/btstream.
+package imdb2torrent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/doingodswork/deflix-stremio/pkg/cache"
+)
+
+// Result is one torrent found for a movie.
+type Result struct {
+	Title    string
+	Quality  string
+	InfoHash string
+}
+
+// Client looks up torrents via YTS, caching results per IMDb ID so repeated
+// stream requests for the same movie don't re-hit the upstream site.
+type Client struct {
+	httpClient   *http.Client
+	torrentCache *cache.Cache
+}
+
+// NewClient creates an imdb2torrent client.
+func NewClient(timeout time.Duration, torrentCache *cache.Cache) *Client {
+	return &Client{
+		httpClient:   &http.Client{Timeout: timeout},
+		torrentCache: torrentCache,
+	}
+}
+
+// FindMovie returns the torrents known for imdbID, all of them sourced from
+// YTS, which indexes by IMDb ID directly.
+func (c *Client) FindMovie(ctx context.Context, imdbID string) ([]Result, error) {
+	if cached, ok := c.torrentCache.Get(imdbID); ok {
+		var results []Result
+		if err := json.Unmarshal(cached, &results); err == nil {
+			return results, nil
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://yts.mx/api/v2/list_movies.json?query_term="+imdbID, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("imdb2torrent: YTS request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var ytsRes struct {
+		Data struct {
+			Movies []struct {
+				Title    string `json:"title"`
+				Torrents []struct {
+					Hash    string `json:"hash"`
+					Quality string `json:"quality"`
+				} `json:"torrents"`
+			} `json:"movies"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&ytsRes); err != nil {
+		return nil, fmt.Errorf("imdb2torrent: couldn't decode YTS response: %w", err)
+	}
+
+	var results []Result
+	for _, movie := range ytsRes.Data.Movies {
+		for _, t := range movie.Torrents {
+			results = append(results, Result{
+				Title:    movie.Title,
+				Quality:  t.Quality,
+				InfoHash: strings.ToLower(t.Hash),
+			})
+		}
+	}
+
+	if encoded, err := json.Marshal(results); err == nil {
+		if err := c.torrentCache.Set(imdbID, encoded); err != nil {
+			log.Println("imdb2torrent: couldn't cache torrent search results:", err)
+		}
+	}
+	return results, nil
+}
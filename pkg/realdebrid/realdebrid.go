@@ -0,0 +1,188 @@
+// Package realdebrid is a client for the RealDebrid API
+// (https://api.real-debrid.com). Client satisfies the pkg/debrid.Client
+// interface directly.
+package realdebrid
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/doingodswork/deflix-stremio/pkg/cache"
+)
+
+const baseURL = "https://api.real-debrid.com/rest/1.0"
+
+// Client is a RealDebrid API client, caching token validation and
+// availability results the same way pkg/debrid/alldebrid does.
+type Client struct {
+	httpClient        *http.Client
+	tokenCache        *cache.Cache
+	availabilityCache *cache.Cache
+}
+
+// NewClient creates a RealDebrid client.
+func NewClient(timeout time.Duration, tokenCache, availabilityCache *cache.Cache) *Client {
+	return &Client{
+		httpClient:        &http.Client{Timeout: timeout},
+		tokenCache:        tokenCache,
+		availabilityCache: availabilityCache,
+	}
+}
+
+// Name is the provider key used in the composite API token and in the
+// Stremio stream labels. It satisfies pkg/debrid.Client.
+func (c *Client) Name() string {
+	return "rd"
+}
+
+// ValidateToken checks that apitoken is accepted by RealDebrid, caching
+// successful results so repeated requests from the same user don't hit
+// /user every time.
+func (c *Client) ValidateToken(ctx context.Context, apitoken string) error {
+	if _, ok := c.tokenCache.Get(apitoken); ok {
+		return nil
+	}
+	if err := c.do(ctx, http.MethodGet, "/user", apitoken, nil, nil); err != nil {
+		return fmt.Errorf("realdebrid: invalid token: %w", err)
+	}
+	if err := c.tokenCache.Set(apitoken, []byte{1}); err != nil {
+		log.Println("realdebrid: couldn't cache token validation result:", err)
+	}
+	return nil
+}
+
+// CheckInstantAvailability returns, for the subset of infohashes RealDebrid
+// has instantly available, true, caching each result per token/hash.
+func (c *Client) CheckInstantAvailability(ctx context.Context, apitoken string, infohashes []string) (map[string]bool, error) {
+	result := make(map[string]bool, len(infohashes))
+
+	uncached := make([]string, 0, len(infohashes))
+	for _, hash := range infohashes {
+		if cached, ok := c.availabilityCache.Get(apitoken + hash); ok {
+			result[hash] = len(cached) > 0 && cached[0] == 1
+		} else {
+			uncached = append(uncached, hash)
+		}
+	}
+	if len(uncached) == 0 {
+		return result, nil
+	}
+
+	path := "/torrents/instantAvailability/" + strings.Join(uncached, "/")
+	var res map[string]struct {
+		RD []map[string]interface{} `json:"rd"`
+	}
+	if err := c.do(ctx, http.MethodGet, path, apitoken, nil, &res); err != nil {
+		return nil, fmt.Errorf("realdebrid: instant availability check failed: %w", err)
+	}
+
+	for _, hash := range uncached {
+		available := len(res[strings.ToLower(hash)].RD) > 0
+		result[hash] = available
+		var flag byte
+		if available {
+			flag = 1
+		}
+		if err := c.availabilityCache.Set(apitoken+hash, []byte{flag}); err != nil {
+			log.Println("realdebrid: couldn't cache availability result:", err)
+		}
+	}
+	return result, nil
+}
+
+// InvalidateAvailability evicts the cached availability result for
+// apitoken/infohash, if any, so the next CheckInstantAvailability call for
+// that pair is a real round trip to RealDebrid instead of a cache hit. Used
+// by /debridbench, which exists to measure that exact round trip.
+func (c *Client) InvalidateAvailability(apitoken, infohash string) error {
+	return c.availabilityCache.Delete(apitoken + infohash)
+}
+
+// GetStreamURL adds infohash as a magnet, selects all its files if it has no
+// links yet, and unrestricts its first link into a direct, playable stream
+// URL. It doesn't poll: if the torrent still has no links after selecting
+// its files, it returns an error.
+func (c *Client) GetStreamURL(ctx context.Context, apitoken, infohash string) (string, error) {
+	magnet := "magnet:?xt=urn:btih:" + infohash
+
+	addForm := url.Values{}
+	addForm.Set("magnet", magnet)
+	var addRes struct {
+		ID string `json:"id"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/torrents/addMagnet", apitoken, addForm, &addRes); err != nil {
+		return "", fmt.Errorf("realdebrid: couldn't add magnet for %v: %w", infohash, err)
+	}
+
+	var info struct {
+		Links []string `json:"links"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/torrents/info/"+addRes.ID, apitoken, nil, &info); err != nil {
+		return "", fmt.Errorf("realdebrid: couldn't get torrent info for %v: %w", infohash, err)
+	}
+	if len(info.Links) == 0 {
+		selectForm := url.Values{}
+		selectForm.Set("files", "all")
+		if err := c.do(ctx, http.MethodPost, "/torrents/selectFiles/"+addRes.ID, apitoken, selectForm, nil); err != nil {
+			return "", fmt.Errorf("realdebrid: couldn't select files for %v: %w", infohash, err)
+		}
+		if err := c.do(ctx, http.MethodGet, "/torrents/info/"+addRes.ID, apitoken, nil, &info); err != nil {
+			return "", fmt.Errorf("realdebrid: couldn't get torrent info for %v: %w", infohash, err)
+		}
+	}
+	if len(info.Links) == 0 {
+		return "", fmt.Errorf("realdebrid: no cached links for %v", infohash)
+	}
+
+	unrestrictForm := url.Values{}
+	unrestrictForm.Set("link", info.Links[0])
+	var unrestrictRes struct {
+		Download string `json:"download"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/unrestrict/link", apitoken, unrestrictForm, &unrestrictRes); err != nil {
+		return "", fmt.Errorf("realdebrid: couldn't unrestrict link for %v: %w", infohash, err)
+	}
+	return unrestrictRes.Download, nil
+}
+
+// do issues an authenticated request against the RealDebrid API. A nil
+// params sends a plain request with no body; a non-nil params is sent as a
+// form body. A nil out skips decoding the response, for fire-and-forget
+// calls like selectFiles.
+func (c *Client) do(ctx context.Context, method, path, apitoken string, params url.Values, out interface{}) error {
+	var body io.Reader
+	if params != nil {
+		body = strings.NewReader(params.Encode())
+	}
+	req, err := http.NewRequestWithContext(ctx, method, baseURL+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+apitoken)
+	if params != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("HTTP %v: %s", resp.StatusCode, b)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
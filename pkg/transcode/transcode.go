@@ -0,0 +1,172 @@
+// Package transcode spawns ffmpeg to transcode a remote stream URL into a
+// format more Stremio clients can play, for sources with codecs like
+// HEVC/AV1/DTS that many clients can't decode.
+package transcode
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"path/filepath"
+)
+
+// HWAccel selects a hardware-accelerated encoder. HWAccelNone, the zero
+// value "" and any unknown value use ffmpeg's software encoder.
+type HWAccel string
+
+const (
+	HWAccelNone  HWAccel = "none"
+	HWAccelVAAPI HWAccel = "vaapi"
+	HWAccelNVENC HWAccel = "nvenc"
+)
+
+// Profile selects the container/segmenting ffmpeg produces.
+type Profile string
+
+const (
+	ProfileHLS  Profile = "hls"
+	ProfileFMP4 Profile = "fmp4"
+)
+
+// Config configures the encoder and the concurrency limit shared by all
+// sessions started by a Transcoder.
+type Config struct {
+	HWAccel       HWAccel
+	MaxConcurrent int
+}
+
+// Transcoder spawns and tracks ffmpeg processes, enforcing a concurrency cap
+// so the server can't be DoS'd into spawning unlimited encoders.
+type Transcoder struct {
+	cfg Config
+	sem chan struct{}
+}
+
+// NewTranscoder creates a Transcoder that allows at most cfg.MaxConcurrent
+// ffmpeg processes to run at once.
+func NewTranscoder(cfg Config) *Transcoder {
+	return &Transcoder{
+		cfg: cfg,
+		sem: make(chan struct{}, cfg.MaxConcurrent),
+	}
+}
+
+// Session wraps a running ffmpeg process. For ProfileFMP4 it exposes the
+// transcoded stream via Stdout, and the caller must call Wait after it's
+// done reading Stdout; for ProfileHLS ffmpeg writes playlist and segment
+// files into OutDir instead, and the concurrency slot is released on its
+// own once the process exits.
+type Session struct {
+	cmd     *exec.Cmd
+	Stdout  io.ReadCloser
+	OutDir  string
+	release func()
+}
+
+// Start spawns ffmpeg to pull sourceURL and transcode it per profile,
+// writing HLS output to outDir (ignored for ProfileFMP4). The process is
+// killed when ctx is done, Close is called, or the process exits on its
+// own - whichever happens first.
+func (t *Transcoder) Start(ctx context.Context, sourceURL string, profile Profile, outDir string) (*Session, error) {
+	select {
+	case t.sem <- struct{}{}:
+	default:
+		return nil, fmt.Errorf("too many concurrent transcodes (max %v)", t.cfg.MaxConcurrent)
+	}
+	release := func() { <-t.sem }
+
+	args := buildArgs(t.cfg.HWAccel, sourceURL, profile, outDir)
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+
+	sess := &Session{cmd: cmd, OutDir: outDir, release: release}
+	if profile == ProfileFMP4 {
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			release()
+			return nil, fmt.Errorf("couldn't attach to ffmpeg stdout: %w", err)
+		}
+		sess.Stdout = stdout
+	}
+	if err := cmd.Start(); err != nil {
+		release()
+		return nil, fmt.Errorf("couldn't start ffmpeg: %w", err)
+	}
+
+	// For ProfileHLS there's no Stdout pipe for a concurrent reader to race
+	// with, so it's safe to reap the process as soon as it exits. For
+	// ProfileFMP4, os/exec requires all Stdout reads to finish before Wait
+	// is called, so that case's caller must call Session.Wait itself once
+	// it's done copying from Stdout.
+	if profile != ProfileFMP4 {
+		go func() {
+			cmd.Wait()
+			release()
+		}()
+	}
+
+	return sess, nil
+}
+
+// Wait blocks until the ffmpeg process exits and releases its concurrency
+// slot. Only meaningful for a ProfileFMP4 session, and must only be called
+// after the caller is done reading from Stdout - calling it concurrently
+// with a Stdout read can truncate the read, per the os/exec docs.
+func (s *Session) Wait() error {
+	err := s.cmd.Wait()
+	s.release()
+	return err
+}
+
+// Close kills the ffmpeg process if it's still running.
+func (s *Session) Close() {
+	if s.cmd.Process != nil {
+		s.cmd.Process.Kill()
+	}
+}
+
+// buildArgs assembles the ffmpeg command line for the given hardware
+// acceleration mode, source and output profile.
+func buildArgs(hwAccel HWAccel, sourceURL string, profile Profile, outDir string) []string {
+	var args []string
+
+	switch hwAccel {
+	case HWAccelVAAPI:
+		args = append(args, "-hwaccel", "vaapi", "-vaapi_device", "/dev/dri/renderD128")
+	case HWAccelNVENC:
+		args = append(args, "-hwaccel", "cuda")
+	}
+
+	args = append(args, "-i", sourceURL)
+
+	switch hwAccel {
+	case HWAccelVAAPI:
+		args = append(args, "-c:v", "h264_vaapi")
+	case HWAccelNVENC:
+		args = append(args, "-c:v", "h264_nvenc")
+	default:
+		args = append(args, "-c:v", "libx264")
+	}
+	args = append(args, "-c:a", "aac")
+
+	switch profile {
+	case ProfileHLS:
+		// Segment URIs in the playlist are prefixed with outDir's last path
+		// element, so a playlist served from /transcode/{id} (with outDir
+		// named after id) has its segments requested from /transcode/{id}/{file}.
+		args = append(args,
+			"-f", "hls",
+			"-hls_time", "6",
+			"-hls_playlist_type", "event",
+			"-hls_base_url", filepath.Base(outDir)+"/",
+			"-hls_segment_filename", outDir+"/segment%05d.ts",
+			outDir+"/playlist.m3u8")
+	case ProfileFMP4:
+		args = append(args,
+			"-f", "mp4",
+			"-movflags", "frag_keyframe+empty_moov+default_base_moof",
+			"pipe:1")
+	}
+
+	return args
+}
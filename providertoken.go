@@ -0,0 +1,41 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/doingodswork/deflix-stremio/pkg/debrid"
+)
+
+// defaultProviderKey is used when an API token has no "prefix:" segment, for
+// backwards compatibility with tokens issued before multi-provider support.
+const defaultProviderKey = "rd"
+
+// parseProviderTokens splits a composite API token into one provider token
+// per configured provider, so a single Stremio user can be set up with
+// several debrid providers at once and get fanned-out results from all of
+// them. Providers are composed with "+", e.g. "rd:XXX+ad:YYY"; a token with
+// no recognized "prefix:" segment is treated as a single, plain RealDebrid
+// token.
+func parseProviderTokens(apitoken string, providers map[string]debrid.Client) map[string]string {
+	tokens := make(map[string]string)
+	for _, segment := range strings.Split(apitoken, "+") {
+		providerKey, token := splitProviderToken(segment)
+		if _, exists := providers[providerKey]; exists {
+			tokens[providerKey] = token
+		}
+	}
+	if len(tokens) == 0 {
+		tokens[defaultProviderKey] = apitoken
+	}
+	return tokens
+}
+
+// splitProviderToken splits a single "rd:XXX" token segment into its
+// provider key and the underlying provider-specific token. A segment
+// without a "prefix:" has no provider key.
+func splitProviderToken(segment string) (providerKey, token string) {
+	if parts := strings.SplitN(segment, ":", 2); len(parts) == 2 {
+		return parts[0], parts[1]
+	}
+	return "", segment
+}
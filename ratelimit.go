@@ -0,0 +1,151 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/time/rate"
+)
+
+// maxRateLimiterEntries bounds the rate limiter map so a flood of distinct
+// API tokens / IPs can't grow it without limit.
+const maxRateLimiterEntries = 64 * 1024
+
+// rateLimiterEntry pairs a token bucket limiter with the time it was last
+// used, so idle entries can be reaped.
+type rateLimiterEntry struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// rateLimiterStore holds one token-bucket limiter per source (API token, or
+// remote IP for the token-less redirect handler), garbage-collecting entries
+// that have been idle for longer than ttl.
+type rateLimiterStore struct {
+	mu      sync.Mutex
+	entries map[string]*rateLimiterEntry
+	rate    rate.Limit
+	burst   int
+	ttl     time.Duration
+}
+
+func newRateLimiterStore(r rate.Limit, burst int, ttl time.Duration) *rateLimiterStore {
+	store := &rateLimiterStore{
+		entries: make(map[string]*rateLimiterEntry),
+		rate:    r,
+		burst:   burst,
+		ttl:     ttl,
+	}
+	go store.reapLoop()
+	return store
+}
+
+// get returns the limiter for key, creating one if it doesn't exist yet.
+func (s *rateLimiterStore) get(key string) *rate.Limiter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if entry, ok := s.entries[key]; ok {
+		entry.lastSeen = time.Now()
+		return entry.limiter
+	}
+
+	if len(s.entries) >= maxRateLimiterEntries {
+		s.reapLocked()
+	}
+	if len(s.entries) >= maxRateLimiterEntries {
+		// Nothing idle to reap, e.g. a flood of distinct sources that are
+		// all genuinely active: evict the least-recently-seen entry so the
+		// map is hard-capped at maxRateLimiterEntries, not just best-effort
+		// bounded by idle reaping.
+		s.evictLRULocked()
+	}
+
+	limiter := rate.NewLimiter(s.rate, s.burst)
+	s.entries[key] = &rateLimiterEntry{limiter: limiter, lastSeen: time.Now()}
+	return limiter
+}
+
+func (s *rateLimiterStore) reapLoop() {
+	ticker := time.NewTicker(s.ttl)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.mu.Lock()
+		s.reapLocked()
+		s.mu.Unlock()
+	}
+}
+
+// reapLocked removes entries that haven't been used for longer than s.ttl.
+// Callers must hold s.mu.
+func (s *rateLimiterStore) reapLocked() {
+	cutoff := time.Now().Add(-s.ttl)
+	for key, entry := range s.entries {
+		if entry.lastSeen.Before(cutoff) {
+			delete(s.entries, key)
+		}
+	}
+}
+
+// evictLRULocked removes the least-recently-seen entry, regardless of
+// whether it's within ttl. Callers must hold s.mu and have already
+// confirmed s.entries is non-empty.
+func (s *rateLimiterStore) evictLRULocked() {
+	var oldestKey string
+	var oldestSeen time.Time
+	first := true
+	for key, entry := range s.entries {
+		if first || entry.lastSeen.Before(oldestSeen) {
+			oldestKey = key
+			oldestSeen = entry.lastSeen
+			first = false
+		}
+	}
+	delete(s.entries, oldestKey)
+}
+
+// rateLimitMiddleware throttles requests per API token, falling back to the
+// remote IP for the token-less redirect handler. Each source gets its own
+// token bucket; a request that would have to wait too long for a free token
+// is rejected with 429 instead of being queued indefinitely.
+func rateLimitMiddleware(store *rateLimiterStore) func(http.Handler) http.Handler {
+	maxDelay := time.Duration(float64(time.Second) / (2 * float64(store.rate)))
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			limiter := store.get(rateLimitKey(r))
+			res := limiter.Reserve()
+			if !res.OK() {
+				res.Cancel()
+				http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+				return
+			}
+			if delay := res.Delay(); delay > maxDelay {
+				res.Cancel()
+				w.Header().Set("Retry-After", strconv.Itoa(int(delay.Seconds()+1)))
+				http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+				return
+			} else if delay > 0 {
+				time.Sleep(delay)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// rateLimitKey identifies the source to rate-limit on: the Stremio API token
+// when the route has one, otherwise the caller's remote IP (used by the
+// token-less /redirect/{id} handler).
+func rateLimitKey(r *http.Request) string {
+	if token, ok := mux.Vars(r)["apitoken"]; ok && token != "" {
+		return token
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/doingodswork/deflix-stremio/pkg/cache"
+	"github.com/doingodswork/deflix-stremio/pkg/transcode"
+)
+
+// hlsSession tracks one ongoing HLS transcode, shared across the initial
+// playlist request and the subsequent segment requests that follow it.
+type hlsSession struct {
+	session    *transcode.Session
+	lastActive time.Time
+}
+
+// transcodeSessions reaps HLS sessions whose temp dirs haven't been touched
+// for idleTimeout, so disk use stays bounded across many short-lived players.
+type transcodeSessions struct {
+	mu          sync.Mutex
+	sessions    map[string]*hlsSession
+	tempDir     string
+	idleTimeout time.Duration
+}
+
+func newTranscodeSessions(tempDir string, idleTimeout time.Duration) *transcodeSessions {
+	s := &transcodeSessions{
+		sessions:    make(map[string]*hlsSession),
+		tempDir:     tempDir,
+		idleTimeout: idleTimeout,
+	}
+	go s.reapLoop()
+	return s
+}
+
+func (s *transcodeSessions) reapLoop() {
+	ticker := time.NewTicker(s.idleTimeout / 2)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.mu.Lock()
+		cutoff := time.Now().Add(-s.idleTimeout)
+		for id, sess := range s.sessions {
+			if sess.lastActive.Before(cutoff) {
+				sess.session.Close()
+				os.RemoveAll(sess.session.OutDir)
+				delete(s.sessions, id)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// getOrStart returns the existing HLS session for id, touching its
+// lastActive time, or starts a new one if none exists yet.
+func (s *transcodeSessions) getOrStart(transcoder *transcode.Transcoder, id, sourceURL string) (*hlsSession, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if sess, ok := s.sessions[id]; ok {
+		sess.lastActive = time.Now()
+		return sess, nil
+	}
+
+	outDir := filepath.Join(s.tempDir, id)
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		return nil, err
+	}
+	session, err := transcoder.Start(context.Background(), sourceURL, transcode.ProfileHLS, outDir)
+	if err != nil {
+		os.RemoveAll(outDir)
+		return nil, err
+	}
+	sess := &hlsSession{session: session, lastActive: time.Now()}
+	s.sessions[id] = sess
+	return sess, nil
+}
+
+// createTranscodeHandler serves /transcode/{id} (and /transcode/{id}/{file}
+// for HLS segments). It resolves id to the same upstream URL the redirect
+// handler would, then transcodes it on the fly via ffmpeg, chosen by the
+// `profile` query parameter (`hls`, the default, or `fmp4`).
+func createTranscodeHandler(redirectCache *cache.Cache, transcoder *transcode.Transcoder, sessions *transcodeSessions) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		urlBytes, ok := redirectCache.Get(id)
+		if !ok {
+			http.Error(w, "unknown stream id", http.StatusNotFound)
+			return
+		}
+		sourceURL := string(urlBytes)
+
+		profile := transcode.Profile(r.URL.Query().Get("profile"))
+		if profile == "" {
+			profile = transcode.ProfileHLS
+		}
+
+		if profile == transcode.ProfileFMP4 {
+			serveFMP4(w, r, transcoder, sourceURL)
+			return
+		}
+		serveHLS(w, r, sessions, transcoder, id, sourceURL, vars["file"])
+	}
+}
+
+func serveFMP4(w http.ResponseWriter, r *http.Request, transcoder *transcode.Transcoder, sourceURL string) {
+	session, err := transcoder.Start(r.Context(), sourceURL, transcode.ProfileFMP4, "")
+	if err != nil {
+		log.Println("Couldn't start transcode:", err)
+		http.Error(w, "couldn't start transcode", http.StatusServiceUnavailable)
+		return
+	}
+	defer session.Close()
+
+	w.Header().Set("Content-Type", "video/mp4")
+	if _, err := io.Copy(w, session.Stdout); err != nil {
+		log.Println("Error streaming transcoded output:", err)
+	}
+	// Only safe to call once all Stdout reads above have completed - see
+	// the Session.Wait doc comment.
+	if err := session.Wait(); err != nil {
+		log.Println("ffmpeg exited with an error:", err)
+	}
+}
+
+func serveHLS(w http.ResponseWriter, r *http.Request, sessions *transcodeSessions, transcoder *transcode.Transcoder, id, sourceURL, file string) {
+	sess, err := sessions.getOrStart(transcoder, id, sourceURL)
+	if err != nil {
+		log.Println("Couldn't start HLS transcode:", err)
+		http.Error(w, "couldn't start transcode", http.StatusServiceUnavailable)
+		return
+	}
+
+	if file == "" {
+		file = "playlist.m3u8"
+	}
+	http.ServeFile(w, r, filepath.Join(sess.session.OutDir, filepath.Clean("/"+file)))
+}